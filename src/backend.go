@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Backend applies a DNS profile to the system using whatever mechanism
+// actually owns DNS here: rewriting resolv.conf directly, or asking the
+// service that owns it (systemd-resolved, NetworkManager) to do so instead.
+type Backend interface {
+	Name() string
+	Apply(profile Profile) error
+	Restore() error
+}
+
+const (
+	backendResolvconf      = "resolvconf"
+	backendSystemdResolved = "systemd-resolved"
+	backendNetworkManager  = "networkmanager"
+)
+
+// detectBackend honours an explicit config.Backend override; otherwise it
+// inspects what resolv.conf actually points at and picks accordingly.
+func detectBackend(config *Config) Backend {
+	switch config.Backend {
+	case backendSystemdResolved:
+		if b, err := NewResolvedBackend(); err == nil {
+			return b
+		}
+		log.Println("backend: systemd-resolved requested but its D-Bus API is unavailable, falling back to resolvconf")
+	case backendNetworkManager:
+		return NewNetworkManagerBackend()
+	case backendResolvconf:
+		// explicit request for the default, nothing to detect
+	case "":
+		if b := autoDetectBackend(); b != nil {
+			return b
+		}
+	default:
+		log.Printf("backend: unknown backend %q, falling back to resolvconf\n", config.Backend)
+	}
+
+	return NewResolvconfBackend(config)
+}
+
+// autoDetectBackend looks at what /etc/resolv.conf resolves to and returns
+// the matching backend, or nil if it looks like a plain, unmanaged file.
+func autoDetectBackend() Backend {
+	target, err := filepath.EvalSymlinks(resolvConfPath)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case strings.Contains(target, "systemd"):
+		if b, err := NewResolvedBackend(); err == nil {
+			return b
+		}
+	case strings.Contains(target, "NetworkManager"):
+		return NewNetworkManagerBackend()
+	}
+	return nil
+}
+
+// ResolvconfBackend is the default backend: write resolv.conf directly,
+// atomically and with backup/restore - the behaviour dnsmng has always had.
+type ResolvconfBackend struct {
+	merge bool
+}
+
+func NewResolvconfBackend(config *Config) *ResolvconfBackend {
+	return &ResolvconfBackend{merge: config.Merge}
+}
+
+func (b *ResolvconfBackend) Name() string { return backendResolvconf }
+
+func (b *ResolvconfBackend) Apply(profile Profile) error {
+	return setDNS(profile, b.merge)
+}
+
+func (b *ResolvconfBackend) Restore() error {
+	return restoreOriginalResolvConf()
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// controlSocketPath is where the daemon listens for client requests.
+const controlSocketPath = "/var/lib/dnsmng/dnsmng.sock"
+
+// controlRequest is a single JSON-over-unix-socket RPC call. One connection
+// carries exactly one request and one response.
+type controlRequest struct {
+	Method string `json:"method"` // SetProfile, GetCurrent, ListProfiles, ReloadConfig, Probe, Restore
+	Name   string `json:"name,omitempty"`
+}
+
+type controlResponse struct {
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Servers []string `json:"servers,omitempty"`
+	Names   []string `json:"names,omitempty"`
+	Latency string   `json:"latency,omitempty"`
+}
+
+// daemon holds the dnsmng daemon's mutable state: the config, which backend
+// and (optionally) embedded forwarder are in play, and which profile is
+// currently active. All of it is guarded by mu since the control socket,
+// the config watcher, and -auto each touch it from their own goroutine.
+type daemon struct {
+	mu              sync.Mutex
+	configPath      string
+	config          *Config
+	backend         Backend
+	fwd             *Forwarder
+	localResolver   bool
+	resolverApplied bool // whether backend has been pointed at the forwarder yet
+	current         string
+}
+
+func newDaemon(configPath string, config *Config, backend Backend, fwd *Forwarder, localResolver bool) *daemon {
+	return &daemon{
+		configPath:    configPath,
+		config:        config,
+		backend:       backend,
+		fwd:           fwd,
+		localResolver: localResolver,
+	}
+}
+
+// snapshotConfig returns the daemon's current config. Callers must not
+// mutate it - reload swaps in a whole new *Config rather than editing one
+// in place.
+func (d *daemon) snapshotConfig() *Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.config
+}
+
+// setProfile switches to the named profile. With a local resolver running,
+// this only swaps the forwarder's upstreams - the backend is left alone
+// once it's pointed at 127.0.0.53, so switching never touches resolv.conf
+// again. Without one, the backend is applied directly every time, as before.
+func (d *daemon) setProfile(name string) error {
+	d.mu.Lock()
+	profile, exists := d.config.DNS[name]
+	fwd := d.fwd
+	backend := d.backend
+	localResolver := d.localResolver
+	needsApply := !localResolver || !d.resolverApplied
+	d.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("DNS entry for '%s' not found in config", name)
+	}
+
+	if fwd != nil {
+		fwd.SetUpstreams(profile.Servers)
+	}
+
+	if needsApply {
+		if err := backend.Apply(effectiveProfile(profile, localResolver)); err != nil {
+			return err
+		}
+		if localResolver {
+			d.mu.Lock()
+			d.resolverApplied = true
+			d.mu.Unlock()
+		}
+	}
+
+	if err := saveLastDNS(name); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.current = name
+	d.mu.Unlock()
+	return nil
+}
+
+// isLocalResolver reports whether the embedded forwarder is the one the OS
+// is pointed at right now.
+func (d *daemon) isLocalResolver() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.localResolver
+}
+
+// getCurrent returns the name and server addresses of the active profile.
+func (d *daemon) getCurrent() (string, []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.current, d.config.DNS[d.current].addrs()
+}
+
+// listProfiles returns the configured profile names, sorted for stable output.
+func (d *daemon) listProfiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.config.DNS))
+	for name := range d.config.DNS {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// reloadConfig re-reads the config file and validates it before swapping it
+// in, so a broken edit can't take down an otherwise-healthy daemon. If this
+// is the first config to require the embedded forwarder - it wasn't needed
+// at daemon startup and no earlier reload has started it - it's started
+// here, lazily, the same way runDaemonCommand would have at startup.
+func (d *daemon) reloadConfig() error {
+	newConfig, err := readConfig(d.configPath)
+	if err != nil {
+		return err
+	}
+	if len(newConfig.DNS) == 0 {
+		return fmt.Errorf("reload rejected: config has no DNS profiles")
+	}
+
+	needsLocalResolver := newConfig.needsLocalResolver()
+
+	d.mu.Lock()
+	d.config = newConfig
+	d.localResolver = needsLocalResolver
+	if !needsLocalResolver {
+		d.resolverApplied = false
+	}
+	startForwarder := needsLocalResolver && d.fwd == nil
+	if startForwarder {
+		d.fwd = NewForwarder(nil)
+	}
+	fwd := d.fwd
+	d.mu.Unlock()
+
+	if startForwarder {
+		go func() {
+			if err := fwd.Start(); err != nil {
+				log.Fatalf("Error starting local resolver: %s\n", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// probe measures the latency of a single named profile without switching to it.
+func (d *daemon) probe(name string) (time.Duration, error) {
+	config := d.snapshotConfig()
+	profile, exists := config.DNS[name]
+	if !exists {
+		return 0, fmt.Errorf("DNS entry for '%s' not found in config", name)
+	}
+	result, err := probeProfile(name, profile.Servers, config.Auto.canaryDomain(), config.Auto.timeout())
+	return result.Latency, err
+}
+
+// restore asks the backend to revert whatever it applied and clears the
+// active marker, same as what a clean shutdown does.
+func (d *daemon) restore() error {
+	d.mu.Lock()
+	backend := d.backend
+	d.mu.Unlock()
+
+	if err := backend.Restore(); err != nil {
+		return err
+	}
+	return clearActive()
+}
+
+// handle dispatches a single control request to the matching daemon method.
+func (d *daemon) handle(req controlRequest) controlResponse {
+	switch req.Method {
+	case "SetProfile":
+		if err := d.setProfile(req.Name); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		name, servers := d.getCurrent()
+		return controlResponse{OK: true, Name: name, Servers: servers}
+
+	case "GetCurrent":
+		name, servers := d.getCurrent()
+		return controlResponse{OK: true, Name: name, Servers: servers}
+
+	case "ListProfiles":
+		return controlResponse{OK: true, Names: d.listProfiles()}
+
+	case "ReloadConfig":
+		if err := d.reloadConfig(); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		return controlResponse{OK: true}
+
+	case "Probe":
+		latency, err := d.probe(req.Name)
+		if err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		return controlResponse{OK: true, Name: req.Name, Latency: latency.String()}
+
+	case "Restore":
+		if err := d.restore(); err != nil {
+			return controlResponse{Error: err.Error()}
+		}
+		return controlResponse{OK: true}
+
+	default:
+		return controlResponse{Error: fmt.Sprintf("unknown method %q", req.Method)}
+	}
+}
+
+// serveControl listens on a unix socket and answers one JSON request per
+// connection. It blocks; run it in a goroutine.
+func (d *daemon) serveControl(socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return err
+	}
+	// A stale socket from a previous, uncleanly-terminated run would
+	// otherwise make the listen below fail with "address already in use".
+	_ = os.Remove(socketPath)
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+func (d *daemon) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var req controlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(conn).Encode(d.handle(req))
+}
+
+// handleReloadSignal reloads the config on SIGHUP, the conventional signal
+// for "re-read your config" daemons.
+func (d *daemon) handleReloadSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	go func() {
+		for range sigCh {
+			if err := d.reloadConfig(); err != nil {
+				log.Printf("reload: %s\n", err)
+				continue
+			}
+			log.Println("reload: config reloaded on SIGHUP")
+		}
+	}()
+}
+
+// watchConfigFile reloads the config whenever it's rewritten on disk, so an
+// editor save takes effect without needing to signal the daemon by hand.
+func (d *daemon) watchConfigFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("config watch: %s\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(d.configPath); err != nil {
+		log.Printf("config watch: %s\n", err)
+		return
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Write == fsnotify.Write {
+				if err := d.reloadConfig(); err != nil {
+					log.Printf("reload: %s\n", err)
+					continue
+				}
+				log.Println("reload: config reloaded after file change")
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("config watch error:", err)
+		}
+	}
+}
+
+// dialDaemon connects to the daemon's control socket.
+func dialDaemon(socketPath string) (net.Conn, error) {
+	return net.DialTimeout("unix", socketPath, 2*time.Second)
+}
+
+// callDaemon sends a single request to the daemon and returns its response.
+func callDaemon(socketPath string, req controlRequest) (controlResponse, error) {
+	conn, err := dialDaemon(socketPath)
+	if err != nil {
+		return controlResponse{}, fmt.Errorf("connecting to dnsmng daemon at %s: %w (is it running?)", socketPath, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return controlResponse{}, err
+	}
+
+	var resp controlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return controlResponse{}, err
+	}
+	if !resp.OK {
+		return resp, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+// directRestore restores DNS without going through a running daemon, e.g.
+// when recovering after a crash. It returns the backend it used so callers
+// can report it even on failure.
+func directRestore(configPath string) (Backend, error) {
+	var backend Backend = NewResolvconfBackend(&Config{})
+	if config, err := readConfig(configPath); err == nil {
+		backend = detectBackend(config)
+	}
+	if err := backend.Restore(); err != nil {
+		return backend, err
+	}
+	return backend, clearActive()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exchangeDoH sends r as a DNS-over-HTTPS request per RFC 8484: the packed
+// query as the body of a POST with content-type application/dns-message.
+// Like the DoT path in upstream.go, it dials u.address() - the literal
+// IP:port - directly and uses SNI only for certificate verification (and
+// the request Host), rather than letting net/http resolve a hostname
+// itself, which would require the OS resolver and could be circular once
+// local_resolver is active.
+func exchangeDoH(u Upstream, r *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	packed, err := r.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.address()
+	dialer := &net.Dialer{Timeout: timeout}
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialTLSContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return tls.DialWithDialer(dialer, network, addr, &tls.Config{ServerName: u.SNI})
+			},
+		},
+	}
+
+	host := u.SNI
+	if host == "" {
+		host = u.Addr
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/dns-query", host), bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected response status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// localResolverAddr is where the embedded forwarder listens. It mirrors
+// Docker/libnetwork's embedded resolver and systemd-resolved's stub: one
+// stable address the OS always points at, regardless of which upstream
+// profile is actually active.
+const localResolverAddr = "127.0.0.53:53"
+
+// maxTLSFailures is how many consecutive DoT/DoH failures an upstream is
+// allowed before the forwarder falls back to querying it over plain UDP 53.
+const maxTLSFailures = 3
+
+// tlsRetryCooldown is how long the forwarder waits after falling back to
+// plain UDP before it retries the encrypted transport, so a few transient
+// handshake failures (e.g. an on-path attacker injecting RSTs) don't
+// downgrade an upstream to cleartext for the rest of the daemon's life.
+const tlsRetryCooldown = 30 * time.Second
+
+const forwardTimeout = 2 * time.Second
+
+type cacheEntry struct {
+	msg     *dns.Msg
+	expires time.Time
+}
+
+// Forwarder is a small caching DNS server. It answers from cache when it
+// can and otherwise forwards to the first upstream that responds. Switching
+// profiles at runtime only swaps the upstream set via SetUpstreams - the
+// listener itself never restarts.
+type Forwarder struct {
+	mu        sync.RWMutex
+	upstreams []Upstream
+
+	cacheMu sync.Mutex
+	cache   map[string]cacheEntry
+
+	failMu   sync.Mutex
+	tlsState map[string]tlsFailureState
+}
+
+// tlsFailureState tracks how many consecutive handshake failures an
+// upstream has had and when the last one was, so the forwarder knows both
+// when to fall back to plain UDP and when it's worth retrying encrypted
+// mode again.
+type tlsFailureState struct {
+	count int
+	last  time.Time
+}
+
+// NewForwarder creates a forwarder that forwards to the given upstreams
+// until SetUpstreams is called.
+func NewForwarder(upstreams []Upstream) *Forwarder {
+	return &Forwarder{
+		upstreams: upstreams,
+		cache:     make(map[string]cacheEntry),
+		tlsState:  make(map[string]tlsFailureState),
+	}
+}
+
+// SetUpstreams atomically swaps the servers queries are forwarded to, e.g.
+// when the active DNS profile changes. If the set actually changed, the
+// cache is cleared too - otherwise a blackholed upstream's cached answer
+// (a sinkholed A record with a long TTL, say) would keep being served
+// straight out of the cache after failover, bypassing the new upstream
+// until the old TTL happened to lapse.
+func (f *Forwarder) SetUpstreams(upstreams []Upstream) {
+	f.mu.Lock()
+	changed := !upstreamsEqual(f.upstreams, upstreams)
+	f.upstreams = upstreams
+	f.mu.Unlock()
+
+	if changed {
+		f.clearCache()
+	}
+}
+
+// upstreamsEqual reports whether two upstream sets are the same servers in
+// the same order.
+func upstreamsEqual(a, b []Upstream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Forwarder) clearCache() {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cache = make(map[string]cacheEntry)
+}
+
+func (f *Forwarder) currentUpstreams() []Upstream {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.upstreams
+}
+
+func cacheKey(q dns.Question) string {
+	return fmt.Sprintf("%s|%d|%d", q.Name, q.Qtype, q.Qclass)
+}
+
+// minTTL returns the smallest TTL across a message's answer records, i.e.
+// how long it's safe to serve the answer from cache.
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+	first := true
+	for _, rr := range msg.Answer {
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+	return ttl
+}
+
+func (f *Forwarder) lookup(q dns.Question) (*dns.Msg, bool) {
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+
+	entry, ok := f.cache[cacheKey(q)]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.msg.Copy(), true
+}
+
+func (f *Forwarder) store(q dns.Question, msg *dns.Msg) {
+	ttl := minTTL(msg)
+	if ttl == 0 {
+		return
+	}
+
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	f.cache[cacheKey(q)] = cacheEntry{msg: msg.Copy(), expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+}
+
+// exchange sends r to u, falling back to plain UDP on port 53 once u has
+// failed its encrypted handshake maxTLSFailures times in a row. Once the
+// cooldown since that last failure has passed, it tries the encrypted
+// transport again instead of staying downgraded forever.
+func (f *Forwarder) exchange(u Upstream, r *dns.Msg) (*dns.Msg, error) {
+	if !u.encrypted() {
+		return exchangeUpstream(u, r, forwardTimeout)
+	}
+
+	if f.shouldFallback(u) {
+		return exchangeUpstream(u.plainFallback(), r, forwardTimeout)
+	}
+
+	resp, err := exchangeUpstream(u, r, forwardTimeout)
+	f.recordTLSResult(u, err == nil)
+	return resp, err
+}
+
+// shouldFallback reports whether u has failed its TLS handshake too many
+// times recently to keep trying it. Past the cooldown since the last
+// failure, it resets the state and returns false so exchange retries
+// encrypted mode on the next query.
+func (f *Forwarder) shouldFallback(u Upstream) bool {
+	f.failMu.Lock()
+	defer f.failMu.Unlock()
+
+	state, ok := f.tlsState[u.Addr]
+	if !ok || state.count < maxTLSFailures {
+		return false
+	}
+	if time.Since(state.last) >= tlsRetryCooldown {
+		delete(f.tlsState, u.Addr)
+		return false
+	}
+	return true
+}
+
+func (f *Forwarder) recordTLSResult(u Upstream, ok bool) {
+	f.failMu.Lock()
+	defer f.failMu.Unlock()
+
+	if ok {
+		delete(f.tlsState, u.Addr)
+		return
+	}
+	state := f.tlsState[u.Addr]
+	state.count++
+	state.last = time.Now()
+	f.tlsState[u.Addr] = state
+}
+
+// ServeDNS implements dns.Handler: answer from cache if possible, otherwise
+// forward to the first upstream that answers and cache the result.
+func (f *Forwarder) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if len(r.Question) == 0 {
+		dns.HandleFailed(w, r)
+		return
+	}
+	q := r.Question[0]
+
+	if cached, ok := f.lookup(q); ok {
+		cached.Id = r.Id
+		w.WriteMsg(cached)
+		return
+	}
+
+	for _, upstream := range f.currentUpstreams() {
+		resp, err := f.exchange(upstream, r)
+		if err != nil {
+			continue
+		}
+
+		f.store(q, resp)
+		w.WriteMsg(resp)
+		return
+	}
+
+	dns.HandleFailed(w, r)
+}
+
+// Start runs the forwarder's UDP and TCP listeners on localResolverAddr. It
+// blocks until a listener fails; run it in a goroutine.
+func (f *Forwarder) Start() error {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", f.ServeDNS)
+
+	errCh := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: localResolverAddr, Net: network, Handler: mux}
+		go func(s *dns.Server) {
+			errCh <- s.ListenAndServe()
+		}(srv)
+	}
+
+	return <-errCh
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	origResolvConfPath = "/var/lib/dnsmng/resolv.conf.orig" // Snapshot of resolv.conf from before dnsmng ever touched it
+	activeMarkerPath   = "/var/lib/dnsmng/active"           // Present while dnsmng is actively managing DNS
+)
+
+// writeResolvConfAtomic writes data to resolv.conf's real target atomically:
+// it writes a temp file in the same directory and renames it into place, so
+// readers never see a half-written file. If resolv.conf is a symlink (as it
+// is under systemd-resolved or NetworkManager), the symlink's target is
+// written to rather than replacing the symlink itself.
+func writeResolvConfAtomic(data []byte) error {
+	target := resolvConfPath
+	if resolved, err := filepath.EvalSymlinks(resolvConfPath); err == nil {
+		target = resolved
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".resolv.conf.dnsmng-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, target)
+}
+
+// backupOriginalResolvConf snapshots the current resolv.conf to
+// origResolvConfPath the first time dnsmng manages DNS, so -restore has
+// something faithful to put back. It is a no-op if a backup already exists.
+func backupOriginalResolvConf() error {
+	if _, err := os.Stat(origResolvConfPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err := os.ReadFile(resolvConfPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(origResolvConfPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(origResolvConfPath, data, 0644)
+}
+
+// restoreOriginalResolvConf puts the backed-up resolv.conf back in place and
+// removes the backup, so a future run starts from a clean slate.
+func restoreOriginalResolvConf() error {
+	data, err := os.ReadFile(origResolvConfPath)
+	if err != nil {
+		return err
+	}
+	if err := writeResolvConfAtomic(data); err != nil {
+		return err
+	}
+	return os.Remove(origResolvConfPath)
+}
+
+// wasUncleanShutdown reports whether the active marker from a previous run
+// is still present, meaning dnsmng was managing DNS and never got a chance
+// to restore it - e.g. it was SIGKILLed or the machine lost power.
+func wasUncleanShutdown() bool {
+	_, err := os.Stat(activeMarkerPath)
+	return err == nil
+}
+
+// markActive records that dnsmng is now managing DNS, so a future run can
+// tell whether this run shut down cleanly.
+func markActive() error {
+	if err := os.MkdirAll(filepath.Dir(activeMarkerPath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(activeMarkerPath, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// clearActive removes the active marker on a clean shutdown.
+func clearActive() error {
+	err := os.Remove(activeMarkerPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// handleShutdownSignals restores DNS via backend and exits cleanly when
+// dnsmng receives SIGINT or SIGTERM, mirroring the cleanup a VPN client does
+// on disconnect.
+func handleShutdownSignals(backend Backend) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigCh
+		log.Printf("Received %s, restoring DNS settings via %s backend\n", sig, backend.Name())
+		if err := backend.Restore(); err != nil {
+			log.Printf("Error restoring DNS on shutdown: %s\n", err)
+		}
+		if err := clearActive(); err != nil {
+			log.Printf("Error clearing active marker: %s\n", err)
+		}
+		os.Exit(0)
+	}()
+}
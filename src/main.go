@@ -3,17 +3,20 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/fsnotify/fsnotify"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
+	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	DNS map[string][]string `yaml:"dns"`
+	DNS           map[string]Profile `yaml:"dns"`
+	Auto          AutoConfig         `yaml:"auto"`
+	Merge         bool               `yaml:"merge"`
+	LocalResolver bool               `yaml:"local_resolver"`
+	Backend       string             `yaml:"backend"` // "", "resolvconf", "systemd-resolved", or "networkmanager"
 }
 
 const (
@@ -36,15 +39,23 @@ func readConfig(filePath string) (*Config, error) {
 	return &config, nil
 }
 
-func setDNS(dnsIPs []string) error {
-	// Create the content for /etc/resolv.conf with multiple nameservers
-	var content strings.Builder
-	for _, ip := range dnsIPs {
-		content.WriteString(fmt.Sprintf("nameserver %s\n", ip))
+// setDNS renders the profile to resolv.conf. In merge mode the existing
+// file's search domains and options are preserved and only the nameserver
+// block is substituted.
+func setDNS(profile Profile, merge bool) error {
+	var content string
+	var err error
+
+	if merge {
+		content, err = mergeResolvConf(resolvConfPath, profile)
+		if err != nil {
+			return err
+		}
+	} else {
+		content = renderResolvConf(profile)
 	}
 
-	// Overwrite /etc/resolv.conf
-	return os.WriteFile("/etc/resolv.conf", []byte(content.String()), 0644)
+	return writeResolvConfAtomic([]byte(content))
 }
 
 // Read the last saved DNS name from a file
@@ -66,8 +77,14 @@ func saveLastDNS(dnsName string) error {
 	return os.WriteFile(lastDNSFilePath, []byte(dnsName), 0644)
 }
 
-// Watch /etc/resolv.conf for changes and restore the DNS settings if modified
-func watchResolvConf(dnsIPs []string) {
+// Watch /etc/resolv.conf for changes and restore the daemon's current
+// profile if modified. Only meaningful for the resolvconf backend - other
+// backends don't own the file, so fighting over it would just race
+// whatever does. The profile to restore is read from d on every write
+// rather than captured once at startup, so it stays correct across a live
+// "dnsmng set" switch or config reload instead of reverting to whatever was
+// active when the watcher was started.
+func watchResolvConf(d *daemon) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		log.Fatal(err)
@@ -86,8 +103,14 @@ func watchResolvConf(dnsIPs []string) {
 
 				if event.Op&fsnotify.Write == fsnotify.Write {
 					log.Println("Detected change in /etc/resolv.conf, restoring DNS settings")
-					err = setDNS(dnsIPs)
-					if err != nil {
+					config := d.snapshotConfig()
+					name, _ := d.getCurrent()
+					profile, exists := config.DNS[name]
+					if !exists {
+						log.Printf("Error restoring DNS: profile %q no longer in config\n", name)
+						continue
+					}
+					if err := setDNS(effectiveProfile(profile, d.isLocalResolver()), config.Merge); err != nil {
 						log.Printf("Error restoring DNS: %s\n", err)
 					}
 				}
@@ -108,67 +131,231 @@ func watchResolvConf(dnsIPs []string) {
 	<-done
 }
 
+// main dispatches to one of dnsmng's subcommands. "daemon" runs the
+// long-lived process that actually manages DNS and serves the control
+// socket; the rest are thin clients that talk to an already-running daemon
+// over it, so switching profiles no longer means killing and relaunching
+// the process that owns the fsnotify watcher and embedded resolver.
 func main() {
-	configPath := flag.String("config", "/etc/dnsmng/config.yaml", "Path to the config file")
-	domain := flag.String("set", "", "DNS name to set (e.g. google, cloudflare)")
-	flag.Parse()
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "daemon":
+		runDaemonCommand(args)
+	case "set":
+		runSetCommand(args)
+	case "current":
+		runCurrentCommand(args)
+	case "list":
+		runListCommand(args)
+	case "reload":
+		runReloadCommand(args)
+	case "probe":
+		runProbeCommand(args)
+	case "restore":
+		runRestoreCommand(args)
+	default:
+		printUsage()
+		os.Exit(1)
+	}
+}
+
+func printUsage() {
+	fmt.Println("Usage: dnsmng <command> [arguments]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  daemon   Run the dnsmng daemon (manages DNS, serves the control socket)")
+	fmt.Println("  set      Switch the daemon to a named DNS profile")
+	fmt.Println("  current  Show the profile the daemon currently has active")
+	fmt.Println("  list     List the DNS profiles the daemon knows about")
+	fmt.Println("  reload   Ask the daemon to reload its config file")
+	fmt.Println("  probe    Ask the daemon to probe a profile's latency")
+	fmt.Println("  restore  Restore DNS to its pre-dnsmng state")
+}
+
+// runDaemonCommand is what used to be the whole of main(): it reads the
+// config, picks a backend, starts the embedded resolver if needed, and then
+// either watches resolv.conf or blocks serving the control socket.
+func runDaemonCommand(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("config", "/etc/dnsmng/config.yaml", "Path to the config file")
+	domain := fs.String("set", "", "DNS name to set initially (e.g. google, cloudflare)")
+	auto := fs.Bool("auto", false, "Continuously probe configured profiles and switch to the fastest healthy one")
+	socketPath := fs.String("socket", controlSocketPath, "Path to the control socket the daemon listens on")
+	fs.Parse(args)
 
-	// Read the configuration
 	config, err := readConfig(*configPath)
 	if err != nil {
 		fmt.Printf("Error reading config file: %s\n", err)
 		os.Exit(1)
 	}
 
-	// If a DNS domain is specified, set it and save it as the last DNS
-	if *domain != "" {
-		dnsIPs, exists := config.DNS[*domain]
-		if !exists {
-			log.Fatalf("DNS entry for '%s' not found in config\n", *domain)
-		}
+	backend := detectBackend(config)
+	log.Printf("Managing DNS via the %s backend\n", backend.Name())
 
-		// Set the DNS in resolv.conf
-		err = setDNS(dnsIPs)
-		if err != nil {
-			log.Fatalf("Error setting DNS: %s\n", err)
+	if backend.Name() == backendResolvconf {
+		if err := backupOriginalResolvConf(); err != nil {
+			log.Fatalf("Error backing up original resolv.conf: %s\n", err)
 		}
+	}
+	if wasUncleanShutdown() {
+		log.Println("Previous dnsmng instance did not shut down cleanly; DNS settings may still be as it left them")
+	}
+	if err := markActive(); err != nil {
+		log.Fatalf("Error marking dnsmng active: %s\n", err)
+	}
+	handleShutdownSignals(backend)
 
-		// Save the last set DNS name
-		err = saveLastDNS(*domain)
-		if err != nil {
-			log.Fatalf("Error saving last DNS: %s\n", err)
+	// With a local resolver, the OS always points at 127.0.0.53; profile
+	// switches swap the forwarder's upstreams instead of rewriting resolv.conf.
+	// A profile using DoT/DoH forces this on even if local_resolver wasn't set,
+	// since resolv.conf can't express an encrypted upstream directly.
+	localResolver := config.needsLocalResolver()
+	var fwd *Forwarder
+	if localResolver {
+		fwd = NewForwarder(nil)
+		go func() {
+			if err := fwd.Start(); err != nil {
+				log.Fatalf("Error starting local resolver: %s\n", err)
+			}
+		}()
+	}
+
+	d := newDaemon(*configPath, config, backend, fwd, localResolver)
+	d.handleReloadSignal()
+	go d.watchConfigFile()
+	go func() {
+		if err := d.serveControl(*socketPath); err != nil {
+			log.Fatalf("Error serving control socket: %s\n", err)
 		}
+	}()
 
-		log.Printf("DNS set to %v for domain '%s'\n", dnsIPs, *domain)
-	} else {
-		// If no domain is specified, read the last DNS and set it on startup
+	// In auto mode we never stop to watch resolv.conf for a single profile;
+	// runAutoMode owns the whole lifecycle (probing, switching, re-probing).
+	if *auto {
+		runAutoMode(d)
+		return
+	}
+
+	initial := *domain
+	if initial == "" {
 		lastDNS, err := readLastDNS()
 		if err != nil || lastDNS == "" {
 			log.Println("No previous DNS set or file missing, defaulting to 'local' DNS")
-
-			// Set 'local' as the default DNS
 			lastDNS = "local"
 		}
+		initial = lastDNS
+	}
 
-		// Set the last used DNS
-		dnsIPs, exists := config.DNS[lastDNS]
-		if !exists {
-			log.Fatalf("DNS entry for '%s' not found in config\n", lastDNS)
-		}
+	if err := d.setProfile(initial); err != nil {
+		log.Fatalf("Error setting DNS: %s\n", err)
+	}
+	name, servers := d.getCurrent()
+	log.Printf("DNS set to %v for profile %q\n", servers, name)
 
-		err = setDNS(dnsIPs)
-		if err != nil {
-			log.Fatalf("Error setting DNS: %s\n", err)
-		}
+	// The resolvconf backend watches the file it just wrote and restores it
+	// if something else overwrites it; other backends don't own the file, so
+	// there's nothing to watch - just keep the process alive for signals and
+	// the control socket.
+	if backend.Name() != backendResolvconf {
+		select {}
+	}
+
+	watchResolvConf(d)
+}
+
+func runSetCommand(args []string) {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: dnsmng set <profile-name>")
+	}
+
+	resp, err := callDaemon(*socketPath, controlRequest{Method: "SetProfile", Name: fs.Arg(0)})
+	if err != nil {
+		log.Fatalf("Error setting DNS profile: %s\n", err)
+	}
+	log.Printf("DNS set to %v for profile %q\n", resp.Servers, resp.Name)
+}
+
+func runCurrentCommand(args []string) {
+	fs := flag.NewFlagSet("current", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	fs.Parse(args)
 
-		log.Printf("Restored last DNS: %s\n", lastDNS)
+	resp, err := callDaemon(*socketPath, controlRequest{Method: "GetCurrent"})
+	if err != nil {
+		log.Fatalf("Error getting current DNS profile: %s\n", err)
 	}
+	fmt.Printf("%s: %v\n", resp.Name, resp.Servers)
+}
 
-	// Watch /etc/resolv.conf for changes
-	dnsIPs, exists := config.DNS[*domain]
-	if !exists {
-		lastDNS, _ := readLastDNS()
-		dnsIPs = config.DNS[lastDNS]
+func runListCommand(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	fs.Parse(args)
+
+	resp, err := callDaemon(*socketPath, controlRequest{Method: "ListProfiles"})
+	if err != nil {
+		log.Fatalf("Error listing DNS profiles: %s\n", err)
+	}
+	for _, name := range resp.Names {
+		fmt.Println(name)
+	}
+}
+
+func runReloadCommand(args []string) {
+	fs := flag.NewFlagSet("reload", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	fs.Parse(args)
+
+	if _, err := callDaemon(*socketPath, controlRequest{Method: "ReloadConfig"}); err != nil {
+		log.Fatalf("Error reloading config: %s\n", err)
+	}
+	log.Println("Config reloaded")
+}
+
+func runProbeCommand(args []string) {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("Usage: dnsmng probe <profile-name>")
+	}
+
+	resp, err := callDaemon(*socketPath, controlRequest{Method: "Probe", Name: fs.Arg(0)})
+	if err != nil {
+		log.Fatalf("Error probing profile: %s\n", err)
+	}
+	fmt.Printf("%s: %s\n", fs.Arg(0), resp.Latency)
+}
+
+// runRestoreCommand asks the running daemon to restore DNS, same as it would
+// on a clean shutdown. If no daemon is reachable - e.g. it was SIGKILLed or
+// the machine lost power - it falls back to restoring directly via
+// directRestore.
+func runRestoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	socketPath := fs.String("socket", controlSocketPath, "Path to the dnsmng daemon's control socket")
+	configPath := fs.String("config", "/etc/dnsmng/config.yaml", "Path to the config file, used if the daemon isn't running")
+	fs.Parse(args)
+
+	if _, err := callDaemon(*socketPath, controlRequest{Method: "Restore"}); err == nil {
+		log.Println("Restored DNS via the running daemon")
+		return
+	}
+
+	log.Println("Daemon not reachable, restoring DNS directly")
+	backend, err := directRestore(*configPath)
+	if err != nil {
+		log.Fatalf("Error restoring DNS via %s backend: %s\n", backend.Name(), err)
 	}
-	watchResolvConf(dnsIPs)
+	log.Printf("Restored DNS via %s backend\n", backend.Name())
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// NetworkManagerBackend manages DNS via nmcli, NetworkManager's own
+// scripting interface, rather than talking to its D-Bus API directly.
+type NetworkManagerBackend struct{}
+
+func NewNetworkManagerBackend() *NetworkManagerBackend {
+	return &NetworkManagerBackend{}
+}
+
+func (b *NetworkManagerBackend) Name() string { return backendNetworkManager }
+
+// Apply points the active connection's DNS at the profile's servers.
+func (b *NetworkManagerBackend) Apply(profile Profile) error {
+	conn, err := nmActiveConnection()
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]string, len(profile.Servers))
+	for i, s := range profile.Servers {
+		addrs[i] = s.Addr
+	}
+
+	if err := runNmcli("connection", "modify", conn, "ipv4.dns", strings.Join(addrs, " ")); err != nil {
+		return err
+	}
+	return runNmcli("connection", "up", conn)
+}
+
+// Restore clears the DNS override, handing control back to whatever
+// NetworkManager would otherwise use (e.g. DHCP).
+func (b *NetworkManagerBackend) Restore() error {
+	conn, err := nmActiveConnection()
+	if err != nil {
+		return err
+	}
+	if err := runNmcli("connection", "modify", conn, "ipv4.dns", ""); err != nil {
+		return err
+	}
+	return runNmcli("connection", "up", conn)
+}
+
+// nmActiveConnection returns the name of the first active NetworkManager
+// connection, which is the one we point DNS changes at.
+func nmActiveConnection() (string, error) {
+	out, err := exec.Command("nmcli", "-t", "-f", "NAME", "connection", "show", "--active").Output()
+	if err != nil {
+		return "", fmt.Errorf("nmcli: %w", err)
+	}
+
+	name := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	if name == "" {
+		return "", fmt.Errorf("no active NetworkManager connection found")
+	}
+	return name, nil
+}
+
+func runNmcli(args ...string) error {
+	if out, err := exec.Command("nmcli", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("nmcli %v: %w: %s", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AutoConfig controls the behaviour of -auto mode: which domain to probe,
+// how often, and what counts as "unhealthy".
+type AutoConfig struct {
+	CanaryDomain     string `yaml:"canary_domain"`
+	IntervalSeconds  int    `yaml:"interval_seconds"`
+	TimeoutSeconds   int    `yaml:"timeout_seconds"`
+	LatencyThreshold int    `yaml:"latency_threshold_ms"`
+}
+
+const (
+	defaultCanaryDomain     = "google.com."
+	defaultProbeInterval    = 30 * time.Second
+	defaultProbeTimeout     = 2 * time.Second
+	defaultLatencyThreshold = 500 * time.Millisecond
+)
+
+func (a AutoConfig) canaryDomain() string {
+	if a.CanaryDomain == "" {
+		return defaultCanaryDomain
+	}
+	return dns.Fqdn(a.CanaryDomain)
+}
+
+func (a AutoConfig) interval() time.Duration {
+	if a.IntervalSeconds <= 0 {
+		return defaultProbeInterval
+	}
+	return time.Duration(a.IntervalSeconds) * time.Second
+}
+
+func (a AutoConfig) timeout() time.Duration {
+	if a.TimeoutSeconds <= 0 {
+		return defaultProbeTimeout
+	}
+	return time.Duration(a.TimeoutSeconds) * time.Second
+}
+
+func (a AutoConfig) latencyThreshold() time.Duration {
+	if a.LatencyThreshold <= 0 {
+		return defaultLatencyThreshold
+	}
+	return time.Duration(a.LatencyThreshold) * time.Millisecond
+}
+
+// probeResult is the outcome of sending the A and AAAA canary queries to a server.
+type probeResult struct {
+	Server  string
+	Latency time.Duration
+	Err     error
+}
+
+// probeServer sends both an A and an AAAA query for canary to u over its
+// own transport and reports whether both answered and how long the pair
+// took. Requiring both catches a server that blackholes just one address
+// family (or is IPv6-only) instead of reporting it healthy on the strength
+// of whichever query happened to succeed.
+func probeServer(u Upstream, canary string, timeout time.Duration) probeResult {
+	start := time.Now()
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(canary, qtype)
+		if _, err := exchangeUpstream(u, msg, timeout); err != nil {
+			return probeResult{Server: u.Addr, Latency: time.Since(start), Err: err}
+		}
+	}
+	return probeResult{Server: u.Addr, Latency: time.Since(start)}
+}
+
+// probeProfile probes every server in a profile and returns the fastest one
+// that answered. It returns an error if none of them did.
+func probeProfile(name string, servers []Upstream, canary string, timeout time.Duration) (probeResult, error) {
+	var best probeResult
+	found := false
+	for _, server := range servers {
+		result := probeServer(server, canary, timeout)
+		if result.Err != nil {
+			continue
+		}
+		if !found || result.Latency < best.Latency {
+			best = result
+			found = true
+		}
+	}
+	if !found {
+		return probeResult{}, fmt.Errorf("profile %q has no reachable server", name)
+	}
+	return best, nil
+}
+
+// selectBestProfile probes every configured profile and returns the name of
+// the fastest reachable one.
+func selectBestProfile(config *Config) (string, error) {
+	canary := config.Auto.canaryDomain()
+	timeout := config.Auto.timeout()
+
+	var bestName string
+	var bestLatency time.Duration
+	found := false
+
+	for name, profile := range config.DNS {
+		result, err := probeProfile(name, profile.Servers, canary, timeout)
+		if err != nil {
+			log.Printf("auto: %s\n", err)
+			continue
+		}
+		log.Printf("auto: profile %q answered via %s in %s\n", name, result.Server, result.Latency)
+		if !found || result.Latency < bestLatency {
+			bestName, bestLatency = name, result.Latency
+			found = true
+		}
+	}
+
+	if !found {
+		return "", fmt.Errorf("no reachable DNS profile found")
+	}
+	return bestName, nil
+}
+
+// runAutoMode picks the fastest reachable profile, applies it through d, and
+// then keeps re-probing the active profile on an interval, failing over to
+// the next-best one if it starts erroring or exceeds the latency threshold.
+// Re-reading d's config on every tick means a config reload takes effect on
+// the next probe without restarting auto mode. The active profile is read
+// from d.getCurrent() on every tick too, rather than tracked in a local
+// variable, so a manual "dnsmng set" through the control socket becomes the
+// new baseline auto probes instead of being silently reverted on the next
+// tick.
+func runAutoMode(d *daemon) {
+	config := d.snapshotConfig()
+
+	initial, err := selectBestProfile(config)
+	if err != nil {
+		log.Fatalf("auto: %s\n", err)
+	}
+	if err := d.setProfile(initial); err != nil {
+		log.Fatalf("auto: error applying profile %q: %s\n", initial, err)
+	}
+	log.Printf("auto: selected %q as the initial DNS profile\n", initial)
+
+	ticker := time.NewTicker(config.Auto.interval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		config = d.snapshotConfig()
+		current, _ := d.getCurrent()
+
+		profile, exists := config.DNS[current]
+		healthy := false
+		if !exists {
+			log.Printf("auto: profile %q no longer exists after reload\n", current)
+		} else {
+			result, err := probeProfile(current, profile.Servers, config.Auto.canaryDomain(), config.Auto.timeout())
+			healthy = err == nil && result.Latency <= config.Auto.latencyThreshold()
+			if healthy {
+				continue
+			}
+			if err != nil {
+				log.Printf("auto: current profile %q failed: %s\n", current, err)
+			} else {
+				log.Printf("auto: current profile %q exceeded latency threshold (%s > %s)\n", current, result.Latency, config.Auto.latencyThreshold())
+			}
+		}
+
+		next, err := selectBestProfile(config)
+		if err != nil {
+			log.Printf("auto: %s, keeping %q\n", err, current)
+			continue
+		}
+		if next == current {
+			continue
+		}
+
+		if err := d.setProfile(next); err != nil {
+			log.Printf("auto: error applying profile %q: %s\n", next, err)
+			continue
+		}
+		log.Printf("auto: switched DNS profile from %q to %q\n", current, next)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Profile is a named DNS configuration: the nameservers to use plus the
+// resolv.conf(5) knobs (search, ndots, timeout, attempts, rotate, options)
+// that should accompany them.
+type Profile struct {
+	Servers  []Upstream
+	Search   []string `yaml:"search"`
+	Ndots    int      `yaml:"ndots"`
+	Timeout  int      `yaml:"timeout"`
+	Attempts int      `yaml:"attempts"`
+	Rotate   bool     `yaml:"rotate"`
+	Options  []string `yaml:"options"`
+}
+
+// UnmarshalYAML lets a profile be written either as the historical shorthand
+// - a bare list of nameserver IPs - or as a full mapping that also carries
+// search/ndots/options alongside the servers.
+func (p *Profile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var servers []Upstream
+	if err := unmarshal(&servers); err == nil {
+		p.Servers = servers
+		return nil
+	}
+
+	type rawProfile struct {
+		Servers  []Upstream `yaml:"servers"`
+		Search   []string   `yaml:"search"`
+		Ndots    int        `yaml:"ndots"`
+		Timeout  int        `yaml:"timeout"`
+		Attempts int        `yaml:"attempts"`
+		Rotate   bool       `yaml:"rotate"`
+		Options  []string   `yaml:"options"`
+	}
+	var raw rawProfile
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	p.Servers = raw.Servers
+	p.Search = raw.Search
+	p.Ndots = raw.Ndots
+	p.Timeout = raw.Timeout
+	p.Attempts = raw.Attempts
+	p.Rotate = raw.Rotate
+	p.Options = raw.Options
+	return nil
+}
+
+// requiresLocalResolver reports whether any server in the profile needs an
+// encrypted transport, which plain resolv.conf can't express - DoT/DoH must
+// be terminated locally by the embedded forwarder instead.
+func (p Profile) requiresLocalResolver() bool {
+	for _, s := range p.Servers {
+		if s.encrypted() {
+			return true
+		}
+	}
+	return false
+}
+
+// effectiveProfile returns the profile that should actually be programmed
+// into the system. With a local resolver running, every backend just points
+// at 127.0.0.53 and the forwarder handles the real upstreams itself.
+func effectiveProfile(profile Profile, localResolver bool) Profile {
+	if !localResolver {
+		return profile
+	}
+	profile.Servers = []Upstream{{Addr: "127.0.0.53", Proto: protoUDP}}
+	return profile
+}
+
+// addrs returns the bare addresses of a profile's servers, for logging.
+func (p Profile) addrs() []string {
+	addrs := make([]string, len(p.Servers))
+	for i, s := range p.Servers {
+		addrs[i] = s.Addr
+	}
+	return addrs
+}
+
+// needsLocalResolver reports whether the embedded forwarder must run: either
+// local_resolver was requested explicitly, or some profile uses DoT/DoH and
+// therefore can't be expressed directly in resolv.conf.
+func (c Config) needsLocalResolver() bool {
+	if c.LocalResolver {
+		return true
+	}
+	for _, p := range c.DNS {
+		if p.requiresLocalResolver() {
+			return true
+		}
+	}
+	return false
+}
+
+// optionLines returns the entries that belong on the resolv.conf "options"
+// line: the dedicated ndots/timeout/attempts/rotate fields first, then any
+// free-form options the profile listed directly.
+func (p Profile) optionLines() []string {
+	var opts []string
+	if p.Ndots > 0 {
+		opts = append(opts, fmt.Sprintf("ndots:%d", p.Ndots))
+	}
+	if p.Timeout > 0 {
+		opts = append(opts, fmt.Sprintf("timeout:%d", p.Timeout))
+	}
+	if p.Attempts > 0 {
+		opts = append(opts, fmt.Sprintf("attempts:%d", p.Attempts))
+	}
+	if p.Rotate {
+		opts = append(opts, "rotate")
+	}
+	return append(opts, p.Options...)
+}
+
+// renderResolvConf builds the full text of a resolv.conf for a profile:
+// one nameserver line per server, then search and options if present.
+func renderResolvConf(p Profile) string {
+	var b strings.Builder
+	for _, s := range p.Servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s.Addr)
+	}
+	if len(p.Search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(p.Search, " "))
+	}
+	if opts := p.optionLines(); len(opts) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(opts, " "))
+	}
+	return b.String()
+}
+
+// optionKey returns the part of a resolv.conf option token before its value
+// separator (e.g. "ndots" for "ndots:5"), or the whole token for boolean
+// options like "rotate" that have none.
+func optionKey(opt string) string {
+	if i := strings.IndexByte(opt, ':'); i >= 0 {
+		return opt[:i]
+	}
+	return opt
+}
+
+// mergeOptions combines the profile's own option tokens with ones read off
+// an existing resolv.conf, keyed so a profile's ndots/timeout/attempts/
+// rotate wins over a same-keyed token pulled from disk rather than sitting
+// alongside it on the same options line.
+func mergeOptions(profileOpts, diskOpts []string) []string {
+	seen := make(map[string]bool, len(profileOpts))
+	merged := make([]string, 0, len(profileOpts)+len(diskOpts))
+	for _, opt := range profileOpts {
+		seen[optionKey(opt)] = true
+		merged = append(merged, opt)
+	}
+	for _, opt := range diskOpts {
+		if seen[optionKey(opt)] {
+			continue
+		}
+		merged = append(merged, opt)
+	}
+	return merged
+}
+
+// mergeResolvConf reads the resolv.conf at path and keeps its "search" and
+// "options" lines, substituting in the profile's own nameservers. A profile
+// that specifies its own search wins over whatever was on disk; options are
+// merged key by key, with the profile's own ndots/timeout/attempts/rotate/
+// options winning over same-keyed tokens read off disk.
+func mergeResolvConf(path string, p Profile) (string, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	var diskSearch, diskOptions []string
+	for _, line := range strings.Split(string(existing), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "search":
+			diskSearch = fields[1:]
+		case "options":
+			diskOptions = fields[1:]
+		}
+	}
+
+	merged := p
+	if len(merged.Search) == 0 {
+		merged.Search = diskSearch
+	}
+	merged.Options = mergeOptions(p.optionLines(), diskOptions)
+	merged.Ndots, merged.Timeout, merged.Attempts, merged.Rotate = 0, 0, 0, false
+
+	return renderResolvConf(merged), nil
+}
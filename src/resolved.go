@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	resolvedDest       = "org.freedesktop.resolve1"
+	resolvedObjectPath = "/org/freedesktop/resolve1"
+)
+
+// resolvedDNSServer matches the (family, address) struct resolve1's
+// SetLinkDNS expects for each server.
+type resolvedDNSServer struct {
+	Family  int32
+	Address []byte
+}
+
+// resolvedDomain matches the (domain, routingOnly) struct SetLinkDomains
+// expects for each search domain.
+type resolvedDomain struct {
+	Domain      string
+	RoutingOnly bool
+}
+
+// ResolvedBackend manages DNS via systemd-resolved's org.freedesktop.resolve1
+// D-Bus API instead of writing resolv.conf directly. Stomping the file
+// doesn't work here: resolved owns it (it's a symlink to its own stub file)
+// and rewrites it right back, the same problem Tailscale's Linux DNS
+// manager solved by talking to resolved over D-Bus instead.
+type ResolvedBackend struct {
+	conn *dbus.Conn
+	link int
+}
+
+// NewResolvedBackend connects to the system bus and picks the primary link
+// to manage. It fails fast if either isn't available, so callers can fall
+// back to another backend.
+func NewResolvedBackend() (*ResolvedBackend, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to system bus: %w", err)
+	}
+
+	link, err := defaultLinkIndex()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &ResolvedBackend{conn: conn, link: link}, nil
+}
+
+func (b *ResolvedBackend) Name() string { return backendSystemdResolved }
+
+// Apply calls SetLinkDNS and SetLinkDomains on the primary link.
+func (b *ResolvedBackend) Apply(profile Profile) error {
+	manager := b.conn.Object(resolvedDest, dbus.ObjectPath(resolvedObjectPath))
+
+	var servers []resolvedDNSServer
+	for _, s := range profile.Servers {
+		ip := net.ParseIP(s.Addr)
+		if ip == nil {
+			continue
+		}
+		if v4 := ip.To4(); v4 != nil {
+			servers = append(servers, resolvedDNSServer{Family: 2, Address: v4}) // AF_INET
+		} else {
+			servers = append(servers, resolvedDNSServer{Family: 10, Address: ip.To16()}) // AF_INET6
+		}
+	}
+
+	call := manager.Call("org.freedesktop.resolve1.Manager.SetLinkDNS", 0, int32(b.link), servers)
+	if call.Err != nil {
+		return fmt.Errorf("SetLinkDNS: %w", call.Err)
+	}
+
+	domains := make([]resolvedDomain, len(profile.Search))
+	for i, d := range profile.Search {
+		domains[i] = resolvedDomain{Domain: d}
+	}
+
+	call = manager.Call("org.freedesktop.resolve1.Manager.SetLinkDomains", 0, int32(b.link), domains)
+	if call.Err != nil {
+		return fmt.Errorf("SetLinkDomains: %w", call.Err)
+	}
+
+	return nil
+}
+
+// Restore asks resolved to forget the per-link settings we pushed, reverting
+// to whatever it would otherwise have used (e.g. from DHCP).
+func (b *ResolvedBackend) Restore() error {
+	manager := b.conn.Object(resolvedDest, dbus.ObjectPath(resolvedObjectPath))
+	call := manager.Call("org.freedesktop.resolve1.Manager.RevertLink", 0, int32(b.link))
+	if call.Err != nil {
+		return fmt.Errorf("RevertLink: %w", call.Err)
+	}
+	return nil
+}
+
+// defaultLinkIndex picks the primary network interface: the first non-
+// loopback interface that's up.
+func defaultLinkIndex() (int, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		return iface.Index, nil
+	}
+	return 0, fmt.Errorf("no active non-loopback network interface found")
+}
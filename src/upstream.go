@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	protoUDP   = "udp"
+	protoTCP   = "tcp"
+	protoTLS   = "tls"
+	protoHTTPS = "https"
+)
+
+// Upstream identifies a single DNS server a profile can use, along with the
+// transport to reach it over: plain UDP/TCP, DNS-over-TLS, or DNS-over-HTTPS.
+type Upstream struct {
+	Addr  string `yaml:"addr"`
+	Proto string `yaml:"proto"` // udp (default), tcp, tls, https
+	Port  int    `yaml:"port"`
+	SNI   string `yaml:"sni"`
+}
+
+// UnmarshalYAML lets an upstream be written either as a bare IP/host (the
+// historical shorthand, implying plain UDP on port 53) or as a full mapping
+// carrying its own proto/port/sni.
+func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var addr string
+	if err := unmarshal(&addr); err == nil {
+		u.Addr = addr
+		u.Proto = protoUDP
+		return nil
+	}
+
+	type rawUpstream Upstream
+	var raw rawUpstream
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	*u = Upstream(raw)
+	if u.Proto == "" {
+		u.Proto = protoUDP
+	}
+	return nil
+}
+
+// encrypted reports whether this upstream needs DoT/DoH rather than plain DNS.
+func (u Upstream) encrypted() bool {
+	return u.Proto == protoTLS || u.Proto == protoHTTPS
+}
+
+// defaultPort returns the conventional port for the upstream's protocol.
+func (u Upstream) defaultPort() int {
+	switch u.Proto {
+	case protoTLS:
+		return 853
+	case protoHTTPS:
+		return 443
+	default:
+		return 53
+	}
+}
+
+// address returns addr:port, preferring an explicit Port over the
+// protocol's default, and leaving an Addr that already carries its own
+// port (e.g. "1.1.1.1:5353") alone.
+func (u Upstream) address() string {
+	if _, _, err := net.SplitHostPort(u.Addr); err == nil {
+		return u.Addr
+	}
+	port := u.Port
+	if port == 0 {
+		port = u.defaultPort()
+	}
+	return net.JoinHostPort(u.Addr, fmt.Sprintf("%d", port))
+}
+
+// plainFallback returns the same server reached over plain UDP on port 53,
+// used once an encrypted upstream has failed its handshake too many times.
+func (u Upstream) plainFallback() Upstream {
+	return Upstream{Addr: u.Addr, Proto: protoUDP}
+}
+
+// dnsClient returns a miekg/dns client configured for this upstream's
+// transport. Not used for protoHTTPS, which goes through exchangeDoH instead.
+func (u Upstream) dnsClient(timeout time.Duration) *dns.Client {
+	client := &dns.Client{Timeout: timeout}
+	switch u.Proto {
+	case protoTCP:
+		client.Net = "tcp"
+	case protoTLS:
+		client.Net = "tcp-tls"
+		client.TLSConfig = &tls.Config{ServerName: u.SNI}
+	default:
+		client.Net = "udp"
+	}
+	return client
+}
+
+// exchangeUpstream sends r to u over whatever transport it specifies.
+func exchangeUpstream(u Upstream, r *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if u.Proto == protoHTTPS {
+		return exchangeDoH(u, r, timeout)
+	}
+	resp, _, err := u.dnsClient(timeout).Exchange(r, u.address())
+	return resp, err
+}